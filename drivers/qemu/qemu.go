@@ -3,17 +3,32 @@ package qemu
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/digitalocean/go-qemu/qmp"
+	gossh "golang.org/x/crypto/ssh"
+
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
@@ -27,6 +42,53 @@ const (
 	privateNetworkName = "docker-machines"
 
 	defaultSSHUser = "docker"
+
+	firmwareBIOS = "bios"
+	firmwareUEFI = "uefi"
+
+	// well-known locations for the UEFI pflash firmware shipped by most
+	// distros; the pair matching the host architecture is used as the
+	// default --qemu-bios value and vars template, whether or not it
+	// exists on the host.
+	defaultUEFICodePathAMD64 = "/usr/share/OVMF/OVMF_CODE.fd"
+	defaultUEFIVarsPathAMD64 = "/usr/share/OVMF/OVMF_VARS.fd"
+	defaultUEFICodePathARM64 = "/usr/share/AAVMF/AAVMF_CODE.fd"
+	defaultUEFIVarsPathARM64 = "/usr/share/AAVMF/AAVMF_VARS.fd"
+
+	// networkUser is the historical behavior: a single QEMU user-mode
+	// NIC with hostfwd rules for ssh and the docker engine. The other
+	// backends give the guest its own routable address on a shared
+	// subnet instead of hiding it behind host port forwards.
+	networkUser        = "user"
+	networkSocketVMNet = "socket_vmnet"
+	networkVDE         = "vde"
+	networkTap         = "tap"
+	networkBridge      = "bridge"
+
+	defaultSocketVMNetPath   = "/var/run/socket_vmnet"
+	defaultSocketVMNetSubnet = "192.168.105.0/24"
+	defaultVDECtlSocket      = "/var/run/vde.ctl"
+	defaultVDEAddress        = "192.168.105.1"
+	defaultDHCPDLeasesPath   = "/var/db/dhcpd_leases"
+
+	provisionerBoot2Docker = "boot2docker"
+	provisionerIgnition    = "ignition"
+
+	ignitionConfigVersion = "3.3.0"
+	ignitionCoreUser      = "core"
+
+	guestDockerSock = "/var/run/docker.sock"
+)
+
+// apiForwardingState tracks whether, and how, the host-side Docker API
+// forwarder is exposing the guest's daemon: not at all, on a machine-local
+// unix socket, or on a host-global TCP port.
+type apiForwardingState int
+
+const (
+	noForwarding apiForwardingState = iota
+	machineLocal
+	hostGlobal
 )
 
 type Driver struct {
@@ -43,6 +105,7 @@ type Driver struct {
 	Boot2DockerURL   string
 	NetworkBridge    string
 	CaCertPath       string
+	ServerCertPath   string
 	PrivateKeyPath   string
 	DiskPath         string
 	CacheMode        string
@@ -53,6 +116,57 @@ type Driver struct {
 	vmLoaded        bool
 	UserDataFile    string
 	CloudConfigRoot string
+
+	// Firmware selects "bios" (legacy) or "uefi" boot. Defaults to "uefi"
+	// on aarch64 and "bios" everywhere else.
+	Firmware string
+	// MachineType is passed as -machine (e.g. "q35", "virt").
+	MachineType string
+	// CPUType is passed as -cpu (e.g. "host", "cortex-a72").
+	CPUType string
+	// UEFICodePath is the read-only pflash firmware image (OVMF_CODE.fd /
+	// AAVMF_CODE.fd). UEFIVarsPath is a per-machine writable copy of the
+	// matching _VARS.fd template, created once in Create and reused by
+	// Start/Restart so NVRAM variables survive reboots.
+	UEFICodePath string
+	UEFIVarsPath string
+
+	// NetworkAddress is the socket_vmnet/vde shared subnet or gateway
+	// address, used to constrain the DHCP lease lookup; the tap/bridge
+	// backends do not read it. NetworkSocket overrides the socket_vmnet or
+	// vde control socket path.
+	NetworkAddress string
+	NetworkSocket  string
+
+	// Provisioner selects how the guest is bootstrapped: "boot2docker"
+	// (the original boot2docker.iso + 9p cloud-config flow) or
+	// "ignition" (a qcow2 image such as Fedora CoreOS/Flatcar, configured
+	// via a generated Ignition config). ImagePath is the source qcow2
+	// (path or URL, downloaded/cached the same way Boot2DockerURL is).
+	// IgnitionFile is an optional user-supplied Butane/Ignition JSON
+	// merged into the generated config.
+	Provisioner  string
+	ImagePath    string
+	IgnitionFile string
+
+	// VirtFS holds raw --qemu-virtfs entries ("host=/path,tag=name[,readonly=true]"),
+	// each mounted into the guest over virtio-9p. VirtiofsMounts holds raw
+	// --qemu-virtiofs entries in the same format, each backed by its own
+	// virtiofsd child process for better performance/semantics than 9p.
+	VirtFS         []string
+	VirtiofsMounts []string
+
+	// DockerSock, if set, is a host unix socket path on which to forward
+	// the guest's Docker API; DockerHostPort, if set, is a host TCP port
+	// to forward it on instead. At most one forwarder runs at a time.
+	DockerSock     string
+	DockerHostPort int
+
+	// apiForwarding/forwarderListener are runtime-only (unexported, so
+	// never persisted to config.json): the forwarder goroutine started
+	// in Start and torn down in Stop/Remove.
+	apiForwarding     apiForwardingState
+	forwarderListener net.Listener
 }
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -74,14 +188,37 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:  "qemu-program",
-			Usage: "Name of program to run",
-			Value: "qemu-system-x86_64",
+			Usage: "Name of program to run. Defaults to the qemu-system binary matching the host architecture",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-machine",
+			Usage: "QEMU -machine type. Defaults to q35 on x86_64 and virt on aarch64/riscv64",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-cpu",
+			Usage: "QEMU -cpu type. Defaults to host when hardware acceleration is available",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-firmware",
+			Usage: "Firmware to boot: bios or uefi. Defaults to uefi on aarch64, bios elsewhere",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-bios",
+			Usage: "Path to the read-only UEFI pflash code image (OVMF_CODE.fd/AAVMF_CODE.fd) used when --qemu-firmware=uefi",
 		},
 		// TODO - support for multiple networks
 		mcnflag.StringFlag{
 			Name:  "qemu-network",
-			Usage: "Name of network to connect to",
-			Value: "default",
+			Usage: "Network backend: user, socket_vmnet, vde, tap, or bridge",
+			Value: networkUser,
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-network-address",
+			Usage: "Subnet/gateway address for the socket_vmnet or vde network backends",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-network-socket",
+			Usage: "Path to the socket_vmnet or vde control socket",
 		},
 		mcnflag.StringFlag{
 			EnvVar: "QEMU_BOOT2DOCKER_URL",
@@ -114,6 +251,35 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:  "qemu-userdata",
 			Usage: "cloud-config userdata file",
 		},
+		mcnflag.StringFlag{
+			Name:  "qemu-provisioner",
+			Usage: "How to bootstrap the guest: boot2docker or ignition",
+			Value: provisionerBoot2Docker,
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-image",
+			Usage: "Path or URL of a qcow2 image (e.g. Fedora CoreOS/Flatcar) to use with --qemu-provisioner=ignition",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-ignition",
+			Usage: "Path to a Butane/Ignition JSON config merged into the one generated for --qemu-provisioner=ignition",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "qemu-virtfs",
+			Usage: "Share a host directory with the guest over virtio-9p: host=/path,tag=name[,readonly=true]. May be given multiple times",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "qemu-virtiofs",
+			Usage: "Share a host directory with the guest over virtiofs: host=/path,tag=name. May be given multiple times",
+		},
+		mcnflag.StringFlag{
+			Name:  "qemu-docker-sock",
+			Usage: "Forward the guest's Docker API to this host unix socket path, e.g. /var/run/docker.sock",
+		},
+		mcnflag.IntFlag{
+			Name:  "qemu-docker-host-port",
+			Usage: "Forward the guest's Docker API to this host TCP port instead of a unix socket",
+		},
 		/* Not yet implemented
 		mcnflag.Flag{
 			Name:  "qemu-no-share",
@@ -127,9 +293,15 @@ func (d *Driver) GetMachineName() string {
 	return d.MachineName
 }
 
+// GetSSHHostname returns the host/address to dial for SSH. The "user"
+// backend only exposes the guest via a host-local hostfwd port, so it is
+// always reached at "localhost"; every other backend gives the guest its
+// own routable address, resolved the same way GetIP does.
 func (d *Driver) GetSSHHostname() (string, error) {
-	return "localhost", nil
-	//return d.GetIP()
+	if d.Network == networkUser || d.Network == "" {
+		return "localhost", nil
+	}
+	return d.GetIP()
 }
 
 func (d *Driver) GetSSHKeyPath() string {
@@ -170,7 +342,28 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.DiskSize = flags.Int("qemu-disk-size")
 	d.CPU = flags.Int("qemu-cpu-count")
 	d.Program = flags.String("qemu-program")
+	if d.Program == "" {
+		d.Program = defaultProgram()
+	}
+	d.Firmware = flags.String("qemu-firmware")
+	if d.Firmware == "" {
+		d.Firmware = defaultFirmware()
+	}
+	d.MachineType = flags.String("qemu-machine")
+	if d.MachineType == "" {
+		d.MachineType = defaultMachineType()
+	}
+	d.CPUType = flags.String("qemu-cpu")
+	if d.CPUType == "" {
+		d.CPUType = defaultCPUType()
+	}
+	d.UEFICodePath = flags.String("qemu-bios")
+	if d.UEFICodePath == "" {
+		d.UEFICodePath = defaultUEFICodePath()
+	}
 	d.Network = flags.String("qemu-network")
+	d.NetworkAddress = flags.String("qemu-network-address")
+	d.NetworkSocket = flags.String("qemu-network-socket")
 	d.Boot2DockerURL = flags.String("qemu-boot2docker-url")
 	d.NetworkBridge = flags.String("qemu-network-bridge")
 	d.CacheMode = flags.String("qemu-cache-mode")
@@ -181,15 +374,36 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.SwarmDiscovery = flags.String("swarm-discovery")
 	d.SSHUser = flags.String("qemu-ssh-user")
 	d.UserDataFile = flags.String("qemu-userdata")
+	d.Provisioner = flags.String("qemu-provisioner")
+	if d.Provisioner == "" {
+		d.Provisioner = provisionerBoot2Docker
+	}
+	d.ImagePath = flags.String("qemu-image")
+	d.IgnitionFile = flags.String("qemu-ignition")
+	d.VirtFS = flags.StringSlice("qemu-virtfs")
+	d.VirtiofsMounts = flags.StringSlice("qemu-virtiofs")
+	d.DockerSock = flags.String("qemu-docker-sock")
+	d.DockerHostPort = flags.Int("qemu-docker-host-port")
 	d.EnginePort = 2376
 	d.FirstQuery = true
 	d.SSHPort = 22
 	d.DiskPath = d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
+	if d.Provisioner == provisionerIgnition {
+		d.CaCertPath = d.ResolveStorePath("ca.pem")
+		d.ServerCertPath = d.ResolveStorePath("server.pem")
+		d.PrivateKeyPath = d.ResolveStorePath("server-key.pem")
+	}
 	return nil
 }
 
 func (d *Driver) GetURL() (string, error) {
 	log.Debugf("GetURL called")
+	switch d.apiForwarding {
+	case machineLocal:
+		return fmt.Sprintf("unix://%s", d.DockerSock), nil
+	case hostGlobal:
+		return fmt.Sprintf("tcp://127.0.0.1:%d", d.DockerHostPort), nil
+	}
 	ip, err := d.GetIP()
 	if err != nil {
 		log.Warnf("Failed to get IP: %s", err)
@@ -198,7 +412,7 @@ func (d *Driver) GetURL() (string, error) {
 	if ip == "" {
 		return "", nil
 	}
-	port, err := d.GetEnginePort()
+	port, err := d.GetPort()
 	if (d.FirstQuery) {
 		d.FirstQuery = false
 		port = 2376
@@ -217,15 +431,166 @@ func NewDriver(hostName, storePath string) drivers.Driver {
 	}
 }
 
+// GetIP resolves the guest's address for the selected network backend. The
+// "user" backend hides the guest behind host port forwards, so it is
+// always reached at 127.0.0.1; every other backend gives the guest its own
+// address on a shared subnet or bridge, which is looked up by DHCP lease or
+// ARP scan keyed on the guest's deterministic MAC address.
 func (d *Driver) GetIP() (string, error) {
-	return "127.0.0.1", nil
+	switch d.Network {
+	case networkSocketVMNet:
+		return d.dhcpLeaseIP(d.networkAddress(defaultSocketVMNetSubnet))
+	case networkVDE:
+		return d.dhcpLeaseIP(d.networkAddress(defaultVDEAddress))
+	case networkTap, networkBridge:
+		return d.arpScanIP()
+	default:
+		return "127.0.0.1", nil
+	}
 }
 
+// GetPort returns the port docker-machine should dial to reach the engine.
+// Under "user" networking the guest is only reachable via the host-unique
+// port picked by getAvailableTCPPort in Create, since many user-mode VMs may
+// share the same host. Every other backend gives the guest a real address,
+// so the engine is dialed directly on its well-known port.
 func (d *Driver) GetPort() (int, error) {
-	return d.EnginePort, nil
+	if d.Network == networkUser || d.Network == "" {
+		return d.EnginePort, nil
+	}
+	return 2376, nil
 }
 
+// networkAddress returns the configured --qemu-network-address, or def if
+// none was given.
+func (d *Driver) networkAddress(def string) string {
+	if d.NetworkAddress != "" {
+		return d.NetworkAddress
+	}
+	return def
+}
+
+// macAddress derives a stable, locally-administered MAC address from the
+// machine name so the same guest always leases the same DHCP address
+// across restarts.
+func (d *Driver) macAddress() string {
+	h := fnv.New32a()
+	h.Write([]byte(d.GetMachineName()))
+	sum := h.Sum32()
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// dhcpLeaseIP looks up the guest's leased address on a socket_vmnet/vde
+// subnet, trying virsh's lease table (when the network is also managed by
+// libvirt) before falling back to the bootpd-style lease database that
+// socket_vmnet and vde-based setups write to. subnet constrains matches to
+// --qemu-network-address's subnet, since macOS's dhcpd_leases file is
+// shared by every vmnet-backed network on the host and a MAC match alone
+// could otherwise pick up a lease from an unrelated one.
+func (d *Driver) dhcpLeaseIP(subnet string) (string, error) {
+	mac := d.macAddress()
+	ipnet := parseSubnet(subnet)
+	if ip, err := lookupVirshLease(d.PrivateNetwork, mac, ipnet); err == nil {
+		return ip, nil
+	}
+	return lookupDHCPDLease(defaultDHCPDLeasesPath, mac, ipnet)
+}
+
+// parseSubnet turns a --qemu-network-address value, either a CIDR
+// ("192.168.105.0/24") or a bare gateway address ("192.168.105.1", taken
+// as a /24), into the network it identifies, or nil if it does not parse.
+func parseSubnet(subnet string) *net.IPNet {
+	if !strings.Contains(subnet, "/") {
+		subnet += "/24"
+	}
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil
+	}
+	return ipnet
+}
+
+func lookupVirshLease(network, mac string, subnet *net.IPNet) (string, error) {
+	out, _, err := cmdOutErr("virsh", "net-dhcp-leases", network)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, mac) {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			ip := net.ParseIP(strings.SplitN(field, "/", 2)[0])
+			if ip == nil || (subnet != nil && !subnet.Contains(ip)) {
+				continue
+			}
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no virsh lease found for %s on %s", mac, network)
+}
+
+// lookupDHCPDLease parses the macOS bootpd lease database format used by
+// socket_vmnet/vde, a series of "{ ... }" blocks each containing a
+// hw_address and ip_address line.
+func lookupDHCPDLease(path, mac string, subnet *net.IPNet) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, block := range strings.Split(string(data), "{") {
+		if !strings.Contains(block, mac) {
+			continue
+		}
+		for _, line := range strings.Split(block, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "ip_address=") {
+				continue
+			}
+			ip := net.ParseIP(strings.Trim(strings.TrimPrefix(line, "ip_address="), "\""))
+			if ip == nil || (subnet != nil && !subnet.Contains(ip)) {
+				continue
+			}
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no DHCP lease found for %s in %s", mac, path)
+}
+
+// arpScanIP looks up the guest's address on a tap/bridge network by
+// scanning the host's ARP table for its MAC address.
+func (d *Driver) arpScanIP() (string, error) {
+	out, _, err := cmdOutErr("arp", "-an")
+	if err != nil {
+		return "", err
+	}
+	mac := d.macAddress()
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, mac) {
+			continue
+		}
+		start := strings.Index(line, "(")
+		end := strings.Index(line, ")")
+		if start >= 0 && end > start {
+			return line[start+1 : end], nil
+		}
+	}
+	return "", fmt.Errorf("no ARP entry found for %s", mac)
+}
+
+// GetState first checks whether the pidfile refers to a live process; if not
+// the VM is considered stopped without ever dialing the (possibly stale)
+// monitor socket. Only when the process is alive do we ask QMP for the
+// precise run state (running vs paused).
 func (d *Driver) GetState() (state.State, error) {
+	pid, err := d.readPID()
+	if err != nil {
+		// no pidfile, or it doesn't parse: treat as not running
+		return state.Stopped, nil
+	}
+	if !processAlive(pid) {
+		return state.Stopped, nil
+	}
 
 	ret, err := d.RunQMPCommand("query-status")
 	if err != nil {
@@ -253,34 +618,54 @@ func (d *Driver) PreCreateCheck() error {
 
 func (d *Driver) Create() error {
 	var err error
-	d.SSHPort, err = getAvailableTCPPort()
-	if err != nil {
-		return err
-	}
-	d.EnginePort, err = getAvailableTCPPort()
-	if err != nil {
-		return err
-	}
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
-		return err
+	if d.Network == networkUser || d.Network == "" {
+		// Only the "user" backend hides the guest behind host port
+		// forwards, so only it needs host-unique ports picked here; every
+		// other backend gives the guest its own address and talks SSH/the
+		// engine on their well-known ports directly.
+		d.SSHPort, err = getAvailableTCPPort()
+		if err != nil {
+			return err
+		}
+		d.EnginePort, err = getAvailableTCPPort()
+		if err != nil {
+			return err
+		}
+	} else {
+		d.SSHPort = 22
 	}
-
 	log.Infof("Creating SSH key...")
 	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
 		return err
 	}
 
-	log.Infof("Creating Disk image...")
-	if err := d.generateDiskImage(d.DiskSize); err != nil {
-		return err
-	}
+	if d.Provisioner == provisionerIgnition {
+		log.Infof("Creating disk image from %s...", d.ImagePath)
+		if err := d.generateIgnitionDiskImage(); err != nil {
+			return err
+		}
+
+		log.Infof("Generating Ignition config...")
+		if err := d.generateIgnitionConfig(); err != nil {
+			return err
+		}
+	} else {
+		b2dutils := mcnutils.NewB2dUtils(d.StorePath)
+		if err := b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
+			return err
+		}
 
-	if d.UserDataFile != "" {
-		log.Infof("Creating Userdata Disk...")
-		if d.CloudConfigRoot, err = d.generateUserdataDisk(d.UserDataFile); err != nil {
+		log.Infof("Creating Disk image...")
+		if err := d.generateDiskImage(d.DiskSize); err != nil {
 			return err
 		}
+
+		if d.UserDataFile != "" {
+			log.Infof("Creating Userdata Disk...")
+			if d.CloudConfigRoot, err = d.generateUserdataDisk(d.UserDataFile); err != nil {
+				return err
+			}
+		}
 	}
 
 	log.Infof("Starting QEMU VM...")
@@ -313,6 +698,394 @@ func getAvailableTCPPort() (int, error) {
 	return 0, fmt.Errorf("unable to allocate tcp port")
 }
 
+// defaultProgram returns the qemu-system binary matching the host
+// architecture, e.g. qemu-system-x86_64, qemu-system-aarch64 or
+// qemu-system-riscv64.
+func defaultProgram() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "qemu-system-aarch64"
+	case "riscv64":
+		return "qemu-system-riscv64"
+	default:
+		return "qemu-system-x86_64"
+	}
+}
+
+// defaultFirmware picks uefi on aarch64, since most arm64 boot2docker/CoreOS
+// images no longer ship a legacy BIOS path, and bios everywhere else.
+func defaultFirmware() string {
+	if runtime.GOARCH == "arm64" {
+		return firmwareUEFI
+	}
+	return firmwareBIOS
+}
+
+func defaultMachineType() string {
+	switch runtime.GOARCH {
+	case "arm64", "riscv64":
+		return "virt"
+	default:
+		return "q35"
+	}
+}
+
+// defaultCPUType returns "host" when KVM (Linux) or HVF (macOS) acceleration
+// is available, otherwise a safe emulated CPU model.
+func defaultCPUType() string {
+	if hwAccelAvailable() {
+		return "host"
+	}
+	if runtime.GOARCH == "arm64" {
+		return "cortex-a72"
+	}
+	return "qemu64"
+}
+
+func hwAccelAvailable() bool {
+	switch runtime.GOOS {
+	case "linux":
+		_, err := os.Stat("/dev/kvm")
+		return err == nil
+	case "darwin":
+		return runtime.GOARCH == "arm64" || runtime.GOARCH == "amd64"
+	default:
+		return false
+	}
+}
+
+// accelArgs returns the flags that enable whatever hardware accelerator
+// hwAccelAvailable found, so defaultCPUType's "host" default actually has
+// an accelerator to run on: KVM on Linux, HVF on macOS.
+func accelArgs() []string {
+	if !hwAccelAvailable() {
+		return nil
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return []string{"-enable-kvm"}
+	case "darwin":
+		return []string{"-accel", "hvf"}
+	default:
+		return nil
+	}
+}
+
+func defaultUEFICodePath() string {
+	if runtime.GOARCH == "arm64" {
+		return defaultUEFICodePathARM64
+	}
+	return defaultUEFICodePathAMD64
+}
+
+func defaultUEFIVarsTemplatePath() string {
+	if runtime.GOARCH == "arm64" {
+		return defaultUEFIVarsPathARM64
+	}
+	return defaultUEFIVarsPathAMD64
+}
+
+// uefiVarsPath returns the path of the per-machine writable copy of the UEFI
+// NVRAM vars file; ensureUEFIVars creates it from the template on first use
+// so it persists across Start/Restart.
+func (d *Driver) uefiVarsPath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, "uefi_vars.fd")
+}
+
+func (d *Driver) ensureUEFIVars() error {
+	if d.UEFIVarsPath == "" {
+		d.UEFIVarsPath = d.uefiVarsPath()
+	}
+	if _, err := os.Stat(d.UEFIVarsPath); err == nil {
+		return nil
+	}
+	template := defaultUEFIVarsTemplatePath()
+	vars, err := ioutil.ReadFile(template)
+	if err != nil {
+		return fmt.Errorf("reading UEFI vars template %s: %s", template, err)
+	}
+	return ioutil.WriteFile(d.UEFIVarsPath, vars, 0644)
+}
+
+// ensureTLSCertificates generates a self-signed CA and a server certificate
+// signed by it at CaCertPath/ServerCertPath/PrivateKeyPath, if they don't
+// already exist, so the ignition-provisioned dockerd has real TLS material
+// to bind rather than running its API open on all interfaces.
+func (d *Driver) ensureTLSCertificates() error {
+	if _, err := os.Stat(d.CaCertPath); err == nil {
+		if _, err := os.Stat(d.ServerCertPath); err == nil {
+			if _, err := os.Stat(d.PrivateKeyPath); err == nil {
+				return nil
+			}
+		}
+	}
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s CA", d.GetMachineName())},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCertDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caCertDER)
+	if err != nil {
+		return err
+	}
+
+	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: d.GetMachineName()},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("0.0.0.0")},
+		DNSNames:     []string{"localhost", d.GetMachineName()},
+	}
+	serverCertDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(d.CaCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCertDER}), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.ServerCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCertDER}), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.PrivateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(serverKey)}), 0600)
+}
+
+// bootArgs returns the flags that attach the guest's boot disk and, for
+// ignition mode, deliver its Ignition config via -fw_cfg: QEMU's virt
+// machine exposes fw_cfg on aarch64 the same way the x86_64 machines do,
+// and it's what Fedora CoreOS/Flatcar's ignition dracut module reads on
+// both architectures.
+func (d *Driver) bootArgs(machineDir string) []string {
+	if d.Provisioner == provisionerIgnition {
+		return []string{
+			"-drive", fmt.Sprintf("if=virtio,format=qcow2,file=%s", d.diskPath()),
+			"-fw_cfg", fmt.Sprintf("name=opt/com.coreos/config,file=%s", d.ignitionConfigPath()),
+		}
+	}
+	return []string{
+		"-boot", "d",
+		"-cdrom", filepath.Join(machineDir, "boot2docker.iso"),
+		d.diskPath(),
+	}
+}
+
+type virtFSMount struct {
+	Host     string
+	Tag      string
+	ReadOnly bool
+}
+
+// parseVirtFSEntries parses --qemu-virtfs/--qemu-virtiofs entries of the
+// form "host=/path,tag=name[,readonly=true]".
+func parseVirtFSEntries(raw []string) ([]virtFSMount, error) {
+	mounts := make([]virtFSMount, 0, len(raw))
+	for _, entry := range raw {
+		var m virtFSMount
+		for _, kv := range strings.Split(entry, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid shared folder entry %q: expected key=value pairs", entry)
+			}
+			switch parts[0] {
+			case "host":
+				m.Host = parts[1]
+			case "tag":
+				m.Tag = parts[1]
+			case "readonly":
+				m.ReadOnly = parts[1] == "true"
+			}
+		}
+		if m.Host == "" || m.Tag == "" {
+			return nil, fmt.Errorf("shared folder entry %q requires both host= and tag=", entry)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// virtfsArgs returns the -fsdev/-device flags for --qemu-virtfs entries,
+// each mounted over virtio-9p. fsdev ids start at 1 since the
+// cloud-config 9p mount (when present) always claims fsdev0.
+func (d *Driver) virtfsArgs() ([]string, error) {
+	mounts, err := parseVirtFSEntries(d.VirtFS)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for i, m := range mounts {
+		fsdevID := fmt.Sprintf("fsdev%d", i+1)
+		opts := fmt.Sprintf("local,security_model=mapped-xattr,id=%s,path=%s", fsdevID, m.Host)
+		if m.ReadOnly {
+			opts += ",readonly=on"
+		}
+		args = append(args,
+			"-fsdev", opts,
+			"-device", fmt.Sprintf("virtio-9p-pci,fsdev=%s,mount_tag=%s", fsdevID, m.Tag))
+	}
+	return args, nil
+}
+
+func (d *Driver) virtiofsSocketPath(tag string) string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, fmt.Sprintf("virtiofsd-%s.sock", tag))
+}
+
+func (d *Driver) virtiofsPidPath(tag string) string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, fmt.Sprintf("virtiofsd-%s.pid", tag))
+}
+
+// startVirtiofsDaemons spawns one virtiofsd per --qemu-virtiofs entry,
+// tracked by its own pidfile in the machine dir so Remove can find and
+// kill it later.
+func (d *Driver) startVirtiofsDaemons() error {
+	mounts, err := parseVirtFSEntries(d.VirtiofsMounts)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		sock := d.virtiofsSocketPath(m.Tag)
+		os.Remove(sock)
+		cmd := exec.Command("virtiofsd",
+			fmt.Sprintf("--socket-path=%s", sock),
+			fmt.Sprintf("--shared-dir=%s", m.Host))
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("starting virtiofsd for tag %s: %s", m.Tag, err)
+		}
+		pid := strconv.Itoa(cmd.Process.Pid)
+		if err := ioutil.WriteFile(d.virtiofsPidPath(m.Tag), []byte(pid), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// virtiofsArgs returns the -chardev/-device flags that attach each
+// virtiofsd's socket to the guest, plus the shared memory-backend-file
+// object vhost-user-fs-pci requires to map guest memory into virtiofsd.
+func (d *Driver) virtiofsArgs() ([]string, error) {
+	mounts, err := parseVirtFSEntries(d.VirtiofsMounts)
+	if err != nil {
+		return nil, err
+	}
+	if len(mounts) == 0 {
+		return nil, nil
+	}
+	var args []string
+	for i, m := range mounts {
+		charID := fmt.Sprintf("char%d", i+1)
+		args = append(args,
+			"-chardev", fmt.Sprintf("socket,id=%s,path=%s", charID, d.virtiofsSocketPath(m.Tag)),
+			"-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=%s,tag=%s", charID, m.Tag))
+	}
+	args = append(args,
+		"-object", fmt.Sprintf("memory-backend-file,id=mem,share=on,mem-path=/dev/shm,size=%dM", d.Memory),
+		"-numa", "node,memdev=mem")
+	return args, nil
+}
+
+// stopVirtiofsDaemons kills every virtiofsd process started for this
+// machine and removes their pidfiles/sockets.
+func (d *Driver) stopVirtiofsDaemons() {
+	mounts, err := parseVirtFSEntries(d.VirtiofsMounts)
+	if err != nil {
+		return
+	}
+	for _, m := range mounts {
+		pidPath := d.virtiofsPidPath(m.Tag)
+		if data, err := ioutil.ReadFile(pidPath); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				if proc, err := os.FindProcess(pid); err == nil {
+					proc.Signal(syscall.SIGKILL)
+				}
+			}
+		}
+		os.Remove(pidPath)
+		os.Remove(d.virtiofsSocketPath(m.Tag))
+	}
+}
+
+// netdevArgs returns the -net/-netdev/-device flags for the selected
+// network backend.
+func (d *Driver) netdevArgs() []string {
+	mac := d.macAddress()
+	switch d.Network {
+	case networkSocketVMNet:
+		// the actual unix-socket handshake with socket_vmnet happens out
+		// of band: wrapNetworkCommand execs qemu via socket_vmnet_client,
+		// which hands it an already-connected fd 3.
+		return []string{
+			"-netdev", "socket,id=net0,fd=3",
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", mac),
+		}
+	case networkVDE:
+		sock := d.NetworkSocket
+		if sock == "" {
+			sock = defaultVDECtlSocket
+		}
+		return []string{
+			"-netdev", fmt.Sprintf("vde,id=net0,sock=%s", sock),
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", mac),
+		}
+	case networkBridge:
+		bridge := d.NetworkBridge
+		if bridge == "" {
+			bridge = "virbr0"
+		}
+		return []string{
+			"-netdev", fmt.Sprintf("bridge,id=net0,br=%s", bridge),
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", mac),
+		}
+	case networkTap:
+		ifname := fmt.Sprintf("tap-%s", d.GetMachineName())
+		return []string{
+			"-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", ifname),
+			"-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", mac),
+		}
+	default: // networkUser
+		return []string{
+			"-net", "nic,vlan=0,model=virtio",
+			"-net", fmt.Sprintf("user,vlan=0,hostfwd=tcp::%d-:22,hostfwd=tcp::%d-:2376,hostname=%s", d.SSHPort, d.EnginePort, d.GetMachineName()),
+		}
+	}
+}
+
+// wrapNetworkCommand adjusts the program/args used to launch QEMU for
+// backends that need to be execed through a helper rather than run
+// directly. socket_vmnet's client wrapper connects to the daemon's control
+// socket, then execs qemu with the resulting fd already open as fd 3.
+func (d *Driver) wrapNetworkCommand(program string, args []string) (string, []string) {
+	if d.Network != networkSocketVMNet {
+		return program, args
+	}
+	sock := d.NetworkSocket
+	if sock == "" {
+		sock = defaultSocketVMNetPath
+	}
+	return "socket_vmnet_client", append([]string{sock, program}, args...)
+}
+
 func (d *Driver) Start() error {
 	// fmt.Printf("Init qemu %s\n", i.VM)
 	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
@@ -321,28 +1094,37 @@ func (d *Driver) Start() error {
 		"-display", "none",
 		"-m", fmt.Sprintf("%d", d.Memory),
 		"-smp", fmt.Sprintf("%d", d.CPU),
-		"-boot", "d",
-		"-cdrom", filepath.Join(machineDir, "boot2docker.iso"),
+		"-pidfile", d.pidfilePath(),
+		"-monitor", "none",
 		"-qmp", fmt.Sprintf("unix:%s,server,nowait", d.monitorPath()),
 	}
 
-	startCmd = append(startCmd,
-		//		"-netdev", "user,id=network0",
-		//		"-device", "virtio-net,netdev=network0",
-		//		"-netdev", fmt.Sprintf("bridge,id=network1,br=%s", d.NetworkBridge),
-		//		"-redir", fmt.Sprintf("tcp:%d::22", d.SSHPort),
-		//		"-device", "virtio-net,netdev=network1",
-		"-net", "nic,vlan=0,model=virtio",
-		"-net", fmt.Sprintf("user,vlan=0,hostfwd=tcp::%d-:22,hostfwd=tcp::%d-:2376,hostname=%s", d.SSHPort, d.EnginePort, d.GetMachineName()),
-	)
+	if d.MachineType != "" {
+		startCmd = append(startCmd, "-machine", d.MachineType)
+	}
+	if d.CPUType != "" {
+		startCmd = append(startCmd, "-cpu", d.CPUType)
+	}
+
+	if d.Firmware == firmwareUEFI {
+		if err := d.ensureUEFIVars(); err != nil {
+			return err
+		}
+		codePath := d.UEFICodePath
+		if codePath == "" {
+			codePath = defaultUEFICodePath()
+		}
+		startCmd = append(startCmd,
+			"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", codePath),
+			"-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", d.UEFIVarsPath),
+		)
+	}
+
+	startCmd = append(startCmd, d.netdevArgs()...)
 
 	startCmd = append(startCmd, "-daemonize")
 
-	// other options
-	// "-enable-kvm" if its available
-	if _, err := os.Stat("/dev/kvm"); err == nil {
-		startCmd = append(startCmd, "-enable-kvm")
-	}
+	startCmd = append(startCmd, accelArgs()...)
 
 	if d.CloudConfigRoot != "" {
 		startCmd = append(startCmd,
@@ -351,20 +1133,47 @@ func (d *Driver) Start() error {
 		startCmd = append(startCmd, "-device", "virtio-9p-pci,id=fs0,fsdev=fsdev0,mount_tag=config-2")
 	}
 
-	// last argument is always the name of the disk image
-	startCmd = append(startCmd, d.diskPath())
+	virtfsArgs, err := d.virtfsArgs()
+	if err != nil {
+		return err
+	}
+	startCmd = append(startCmd, virtfsArgs...)
 
-	if stdout, stderr, err := cmdOutErr(d.Program, startCmd...); err != nil {
+	if len(d.VirtiofsMounts) > 0 {
+		if err := d.startVirtiofsDaemons(); err != nil {
+			return err
+		}
+	}
+	virtiofsArgs, err := d.virtiofsArgs()
+	if err != nil {
+		return err
+	}
+	startCmd = append(startCmd, virtiofsArgs...)
+
+	// boot device args go last: for boot2docker mode the disk image is a
+	// bare positional arg, conventionally placed at the end of the command
+	// line.
+	startCmd = append(startCmd, d.bootArgs(machineDir)...)
+
+	program, startCmd := d.wrapNetworkCommand(d.Program, startCmd)
+	if stdout, stderr, err := cmdOutErr(program, startCmd...); err != nil {
 		fmt.Printf("OUTPUT: %s\n", stdout)
 		fmt.Printf("ERROR: %s\n", stderr)
 		return err
 		//if err := cmdStart(d.Program, startCmd...); err != nil {
 		//	return err
 	}
-	log.Infof("Waiting for VM to start (ssh -p %d docker@localhost)...", d.SSHPort)
+	sshHostname, err := d.GetSSHHostname()
+	if err != nil {
+		return err
+	}
+	log.Infof("Waiting for VM to start (ssh -p %d docker@%s)...", d.SSHPort, sshHostname)
+
+	if err := WaitForTCPWithDelay(fmt.Sprintf("%s:%d", sshHostname, d.SSHPort), time.Second); err != nil {
+		return err
+	}
 
-	//return ssh.WaitForTCP(fmt.Sprintf("localhost:%d", d.SSHPort))
-	return WaitForTCPWithDelay(fmt.Sprintf("localhost:%d", d.SSHPort), time.Second)
+	return d.startAPIForwarding()
 }
 
 func cmdOutErr(cmdStr string, args ...string) (string, string, error) {
@@ -398,28 +1207,49 @@ func cmdStart(cmdStr string, args ...string) error {
 	return cmd.Start()
 }
 
+// Stop asks the guest to power down cleanly via QMP and waits for the qemu
+// process itself to exit, rather than trusting the ACPI shutdown to have
+// actually taken effect.
 func (d *Driver) Stop() error {
-	// _, err := d.RunQMPCommand("stop")
-	_, err := d.RunQMPCommand("system_powerdown")
+	pid, err := d.readPID()
 	if err != nil {
+		// nothing to stop
+		return nil
+	}
+
+	if _, err := d.RunQMPCommand("system_powerdown"); err != nil {
 		return err
 	}
-	return nil
+
+	err = waitForProcessExit(pid, 120*time.Second)
+	d.stopAPIForwarding()
+	d.stopVirtiofsDaemons()
+	return err
 }
 
+// Remove force-kills the VM if it's still running, stops the API forwarder
+// and any virtiofsd daemons, then removes the pidfile, the QMP monitor
+// socket, the boot disk (disk.qcow2) and the generated Ignition config.
+// Other files in the machine directory, such as the UEFI vars copy, the
+// boot2docker ISO and the raw disk staging file, are left in place.
 func (d *Driver) Remove() error {
 	s, err := d.GetState()
 	if err != nil {
 		return err
 	}
-	if s == state.Running {
+	if s == state.Running || s == state.Paused {
 		if err := d.Kill(); err != nil {
 			return err
 		}
 	}
-	_, err = d.RunQMPCommand("quit")
-	if err != nil {
-		return err
+
+	d.stopAPIForwarding()
+	d.stopVirtiofsDaemons()
+
+	for _, f := range []string{d.pidfilePath(), d.monitorPath(), d.diskPath(), d.ignitionConfigPath()} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove %s: %s", f, err)
+		}
 	}
 	return nil
 }
@@ -438,13 +1268,23 @@ func (d *Driver) Restart() error {
 	return d.Start()
 }
 
+// Kill sends SIGKILL directly to the qemu process; unlike Stop it does not
+// go through QMP, since a hung or unresponsive guest may never ack a
+// system_powerdown.
 func (d *Driver) Kill() error {
-	// _, err := d.RunQMPCommand("quit")
-	_, err := d.RunQMPCommand("system_powerdown")
+	pid, err := d.readPID()
+	if err != nil {
+		// already gone
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := proc.Signal(syscall.SIGKILL); err != nil && processAlive(pid) {
+		return err
+	}
+	return waitForProcessExit(pid, 30*time.Second)
 }
 
 func (d *Driver) StartDocker() error {
@@ -486,6 +1326,46 @@ func (d *Driver) monitorPath() string {
 	return filepath.Join(machineDir, "monitor")
 }
 
+func (d *Driver) pidfilePath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, "qemu.pid")
+}
+
+// readPID returns the pid qemu wrote to -pidfile. Any error (file missing,
+// empty, unparseable) is treated as "not running" by the caller.
+func (d *Driver) readPID() (int, error) {
+	data, err := ioutil.ReadFile(d.pidfilePath())
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing pidfile %s: %s", d.pidfilePath(), err)
+	}
+	return pid, nil
+}
+
+// processAlive reports whether pid refers to a live process, using the
+// conventional signal-0 probe.
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+func waitForProcessExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("qemu process %d did not exit within %s", pid, timeout)
+}
+
 // Make a boot2docker VM disk image.
 func (d *Driver) generateDiskImage(size int) error {
 	log.Debugf("Creating %d MB hard disk image...", size)
@@ -588,93 +1468,368 @@ func (d *Driver) generateUserdataDisk(userdataFile string) (string, error) {
 
 }
 
-func (d *Driver) RunQMPCommand(command string) (map[string]interface{}, error) {
+func (d *Driver) ignitionConfigPath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, "ignition.json")
+}
 
-	// connect to monitor
-	conn, err := net.Dial("unix", d.monitorPath())
+// generateIgnitionDiskImage resolves --qemu-image (downloading it into a
+// shared cache if it's a URL) and creates the machine's boot disk as a
+// qcow2 overlay backed by that cached image, so the cache stays read-only
+// and shareable across machines.
+func (d *Driver) generateIgnitionDiskImage() error {
+	base, err := d.cacheImage()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer conn.Close()
+	if stdout, stderr, err := cmdOutErr("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", base, d.diskPath()); err != nil {
+		fmt.Printf("OUTPUT: %s\n", stdout)
+		fmt.Printf("ERROR: %s\n", stderr)
+		return err
+	}
+	return nil
+}
+
+// cacheImage returns a local path for --qemu-image, downloading it into
+// StorePath/cache first if it was given as an http(s) URL.
+func (d *Driver) cacheImage() (string, error) {
+	if d.ImagePath == "" {
+		return "", fmt.Errorf("--qemu-image is required when --qemu-provisioner=%s", provisionerIgnition)
+	}
+	if !strings.HasPrefix(d.ImagePath, "http://") && !strings.HasPrefix(d.ImagePath, "https://") {
+		return d.ImagePath, nil
+	}
+
+	cacheDir := filepath.Join(d.StorePath, "cache")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(cacheDir, filepath.Base(d.ImagePath))
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	log.Infof("Downloading %s...", d.ImagePath)
+	resp, err := http.Get(d.ImagePath)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+type ignitionFile struct {
+	Path      string `json:"path"`
+	Mode      int    `json:"mode"`
+	Overwrite bool   `json:"overwrite"`
+	Contents  struct {
+		Source string `json:"source"`
+	} `json:"contents"`
+}
+
+func ignitionInlineFile(path string, mode int, contents []byte) ignitionFile {
+	f := ignitionFile{Path: path, Mode: mode, Overwrite: true}
+	f.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString(contents)
+	return f
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []ignitionUser `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []ignitionFile `json:"files"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []ignitionUnit `json:"units"`
+	} `json:"systemd"`
+}
+
+// generateIgnitionConfig writes the Ignition config that bootstraps a
+// Fedora CoreOS/Flatcar guest: it authorizes the generated SSH key for the
+// "core" user, sets the hostname, and enables a dockerd listening on 2376
+// with --tlsverify against a self-signed CA/server certificate generated
+// by ensureTLSCertificates. A user-supplied --qemu-ignition file, if given,
+// is merged in on top.
+func (d *Driver) generateIgnitionConfig() error {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	var cfg ignitionConfig
+	cfg.Ignition.Version = ignitionConfigVersion
+	cfg.Passwd.Users = append(cfg.Passwd.Users, ignitionUser{
+		Name:              ignitionCoreUser,
+		SSHAuthorizedKeys: []string{strings.TrimSpace(string(pubKey))},
+	})
+	cfg.Storage.Files = append(cfg.Storage.Files,
+		ignitionInlineFile("/etc/hostname", 0644, []byte(d.GetMachineName())))
+
+	if d.CaCertPath == "" || d.ServerCertPath == "" || d.PrivateKeyPath == "" {
+		return fmt.Errorf("ignition provisioning requires TLS certificate paths to be set")
+	}
+	if err := d.ensureTLSCertificates(); err != nil {
+		return fmt.Errorf("generating Docker TLS certificates: %s", err)
+	}
+	caCert, err := ioutil.ReadFile(d.CaCertPath)
+	if err != nil {
+		return err
+	}
+	serverCert, err := ioutil.ReadFile(d.ServerCertPath)
+	if err != nil {
+		return err
+	}
+	serverKey, err := ioutil.ReadFile(d.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	cfg.Storage.Files = append(cfg.Storage.Files,
+		ignitionInlineFile("/etc/docker/tls/ca.pem", 0644, caCert),
+		ignitionInlineFile("/etc/docker/tls/server.pem", 0644, serverCert),
+		ignitionInlineFile("/etc/docker/tls/server-key.pem", 0600, serverKey))
+	dockerFlags := "-H unix:///var/run/docker.sock -H tcp://0.0.0.0:2376" +
+		" --tlsverify --tlscacert=/etc/docker/tls/ca.pem" +
+		" --tlscert=/etc/docker/tls/server.pem --tlskey=/etc/docker/tls/server-key.pem"
+
+	cfg.Systemd.Units = append(cfg.Systemd.Units, ignitionUnit{
+		Name:    "docker.service",
+		Enabled: true,
+		Contents: fmt.Sprintf(
+			"[Unit]\nDescription=Docker Application Container Engine\nAfter=network-online.target\nWants=network-online.target\n\n"+
+				"[Service]\nExecStart=\nExecStart=/usr/bin/dockerd %s\n\n[Install]\nWantedBy=multi-user.target\n",
+			dockerFlags),
+	})
+
+	if d.IgnitionFile != "" {
+		extra, err := ioutil.ReadFile(d.IgnitionFile)
+		if err != nil {
+			return err
+		}
+		var user ignitionConfig
+		if err := json.Unmarshal(extra, &user); err != nil {
+			return fmt.Errorf("parsing --qemu-ignition %s: %s", d.IgnitionFile, err)
+		}
+		cfg.Passwd.Users = append(cfg.Passwd.Users, user.Passwd.Users...)
+		cfg.Storage.Files = append(cfg.Storage.Files, user.Storage.Files...)
+		cfg.Systemd.Units = append(cfg.Systemd.Units, user.Systemd.Units...)
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ignitionConfigPath(), data, 0644)
+}
 
-	// initial QMP response
-	var buf [1024]byte
-	nr, err := conn.Read(buf[:])
+// qmpDialTimeout bounds the dial of the QMP monitor socket. The greeting,
+// the qmp_capabilities handshake and the command round-trip that follow
+// have no deadline of their own.
+const qmpDialTimeout = 5 * time.Second
+
+// RunQMPCommand executes a single QMP command against the machine's monitor
+// socket using a go-qemu SocketMonitor, which takes care of the greeting and
+// qmp_capabilities handshake.
+func (d *Driver) RunQMPCommand(command string) (map[string]interface{}, error) {
+	mon, err := qmp.NewSocketMonitor("unix", d.monitorPath(), qmpDialTimeout)
 	if err != nil {
 		return nil, err
 	}
-	type qmpInitialResponse struct {
-		QMP struct {
-			Version struct {
-				QEMU struct {
-					Micro int `json:"micro"`
-					Minor int `json:"minor"`
-					Major int `json:"major"`
-				} `json:"qemu"`
-				Package string `json:"package"`
-			} `json:"version"`
-			Capabilities []string `json:"capabilities"`
-		} `jason:"QMP"`
-	}
-
-	var initialResponse qmpInitialResponse
-	json.Unmarshal(buf[:nr], &initialResponse)
-
-	// run 'qmp_capabilities' to switch to command mode
-	// { "execute": "qmp_capabilities" }
+	if err := mon.Connect(); err != nil {
+		return nil, err
+	}
+	defer mon.Disconnect()
+
 	type qmpCommand struct {
 		Command string `json:"execute"`
 	}
-	jsonCommand, err := json.Marshal(qmpCommand{Command: "qmp_capabilities"})
+	rawCommand, err := json.Marshal(qmpCommand{Command: command})
 	if err != nil {
 		return nil, err
 	}
-	_, err = conn.Write(jsonCommand)
+
+	rawResponse, err := mon.Run(rawCommand)
 	if err != nil {
 		return nil, err
 	}
-	nr, err = conn.Read(buf[:])
-	if err != nil {
-		return nil, err
+
+	type qmpError struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
 	}
 	type qmpResponse struct {
 		Return map[string]interface{} `json:"return"`
+		Error  *qmpError              `json:"error"`
 	}
 	var response qmpResponse
-	err = json.Unmarshal(buf[:nr], &response)
-	if err != nil {
+	if err := json.Unmarshal(rawResponse, &response); err != nil {
 		return nil, err
 	}
-	// expecting empty response
-	if len(response.Return) != 0 {
-		return nil, fmt.Errorf("qmp_capabilities failed: %v", response.Return)
+	if response.Error != nil {
+		return nil, fmt.Errorf("%s failed: %s: %s", command, response.Error.Class, response.Error.Desc)
 	}
+	return response.Return, nil
+}
 
-	// { "execute": command }
-	jsonCommand, err = json.Marshal(qmpCommand{Command: command})
+// startAPIForwarding opens the configured host-side listener (a unix
+// socket for --qemu-docker-sock, or a TCP port for --qemu-docker-host-port)
+// and proxies every accepted connection to the guest's Docker API over SSH.
+// It is a no-op, leaving apiForwarding at noForwarding, if neither flag was
+// set.
+func (d *Driver) startAPIForwarding() error {
+	var listener net.Listener
+	var err error
+	switch {
+	case d.DockerSock != "":
+		os.Remove(d.DockerSock)
+		if listener, err = net.Listen("unix", d.DockerSock); err != nil {
+			return fmt.Errorf("forwarding Docker API to %s: %s", d.DockerSock, err)
+		}
+		d.apiForwarding = machineLocal
+	case d.DockerHostPort != 0:
+		if listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", d.DockerHostPort)); err != nil {
+			return fmt.Errorf("forwarding Docker API to port %d: %s", d.DockerHostPort, err)
+		}
+		d.apiForwarding = hostGlobal
+	default:
+		d.apiForwarding = noForwarding
+		return nil
+	}
+
+	d.forwarderListener = listener
+	go d.acceptForwardedConns(listener)
+
+	return d.probeAPIForwarding()
+}
+
+// stopAPIForwarding closes the forwarder's listener, unblocking its accept
+// loop, and removes the unix socket it was bound to (if any).
+func (d *Driver) stopAPIForwarding() {
+	if d.forwarderListener == nil {
+		return
+	}
+	d.forwarderListener.Close()
+	d.forwarderListener = nil
+	if d.apiForwarding == machineLocal && d.DockerSock != "" {
+		os.Remove(d.DockerSock)
+	}
+	d.apiForwarding = noForwarding
+}
+
+func (d *Driver) acceptForwardedConns(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// listener was closed by stopAPIForwarding, or a transient
+			// accept error; either way there's nothing more to do here.
+			return
+		}
+		go d.forwardConn(conn)
+	}
+}
+
+// forwardConn proxies a single accepted connection to the guest's Docker
+// API unix socket over an SSH connection authenticated with the machine's
+// own key, the same credentials ssh.NewNativeClient uses for `docker-machine ssh`.
+func (d *Driver) forwardConn(conn net.Conn) {
+	defer conn.Close()
+
+	client, err := d.dialGuestSSH()
 	if err != nil {
-		return nil, err
+		log.Debugf("Docker API forwarder: SSH dial failed: %s", err)
+		return
+	}
+	defer client.Close()
+
+	remote, err := client.Dial("unix", guestDockerSock)
+	if err != nil {
+		log.Debugf("Docker API forwarder: dialing %s in guest failed: %s", guestDockerSock, err)
+		return
 	}
-	_, err = conn.Write(jsonCommand)
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (d *Driver) dialGuestSSH() (*gossh.Client, error) {
+	key, err := ioutil.ReadFile(d.GetSSHKeyPath())
 	if err != nil {
 		return nil, err
 	}
-	nr, err = conn.Read(buf[:])
+	signer, err := gossh.ParsePrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(buf[:nr], &response)
+	config := &gossh.ClientConfig{
+		User:            d.GetSSHUsername(),
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	sshHostname, err := d.GetSSHHostname()
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(command, "query-") {
-		return response.Return, nil
+	return gossh.Dial("tcp", fmt.Sprintf("%s:%d", sshHostname, d.SSHPort), config)
+}
+
+// probeAPIForwarding gives the freshly-opened forwarder endpoint a short
+// reachability check and logs which mode ended up active, so users know
+// what to set DOCKER_HOST to without digging through driver internals.
+func (d *Driver) probeAPIForwarding() error {
+	var network, addr string
+	switch d.apiForwarding {
+	case machineLocal:
+		network, addr = "unix", d.DockerSock
+	case hostGlobal:
+		network, addr = "tcp", fmt.Sprintf("127.0.0.1:%d", d.DockerHostPort)
+	default:
+		return nil
 	}
-	// non-query commands should return an empty response
-	if len(response.Return) != 0 {
-		return nil, fmt.Errorf("%s failed: %v", command, response.Return)
+
+	conn, err := net.DialTimeout(network, addr, 3*time.Second)
+	if err != nil {
+		log.Warnf("Docker API forwarding endpoint %s://%s is not yet reachable: %s", network, addr, err)
+		return nil
 	}
-	return response.Return, nil
+	conn.Close()
+
+	url, _ := d.GetURL()
+	log.Infof("Docker API forwarding active: export DOCKER_HOST=%s", url)
+	return nil
 }
 
 func WaitForTCPWithDelay(addr string, duration time.Duration) error {